@@ -0,0 +1,390 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// EventSource produces one IAMEvent at a time. Implementations may block
+// (e.g. long-polling SQS) until an event is available or ctx is cancelled.
+type EventSource interface {
+	Next(ctx context.Context) (IAMEvent, error)
+}
+
+// elevatedSeverity applies the same bump-to-high rules regardless of
+// whether the event came from the fake generator or real CloudTrail, so
+// the two sources stay behaviorally indistinguishable downstream.
+func elevatedSeverity(actor, action, severity string) string {
+	if actor == "unknown_user" || action == "DeleteUser" || action == "CreateAccessKey" {
+		return "high"
+	}
+	return severity
+}
+
+// FakeSource is the original synthetic generator, now wrapped behind
+// EventSource so main can treat it the same as a real source.
+type FakeSource struct{}
+
+func (FakeSource) Next(ctx context.Context) (IAMEvent, error) {
+	return generateFakeIAMEvent(), nil
+}
+
+// cloudTrailRecord mirrors the subset of the CloudTrail record shape we
+// care about. Unknown fields are preserved via the Raw map on IAMEvent.
+type cloudTrailRecord struct {
+	EventName    string `json:"eventName"`
+	EventTime    string `json:"eventTime"`
+	UserIdentity struct {
+		ARN string `json:"arn"`
+	} `json:"userIdentity"`
+	RequestParameters map[string]interface{} `json:"requestParameters"`
+}
+
+func (r cloudTrailRecord) target() string {
+	if r.RequestParameters == nil {
+		return ""
+	}
+	if v, ok := r.RequestParameters["userName"].(string); ok && v != "" {
+		return v
+	}
+	if v, ok := r.RequestParameters["roleName"].(string); ok && v != "" {
+		return v
+	}
+	return ""
+}
+
+func (r cloudTrailRecord) toIAMEvent(raw map[string]interface{}) IAMEvent {
+	ts := r.EventTime
+	if ts == "" {
+		ts = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	ev := IAMEvent{
+		Source:    "aws_cloudtrail",
+		Category:  "iam",
+		Action:    r.EventName,
+		Actor:     r.UserIdentity.ARN,
+		Target:    r.target(),
+		Severity:  "low",
+		Timestamp: ts,
+		Raw:       raw,
+	}
+	ev.Severity = elevatedSeverity(ev.Actor, ev.Action, ev.Severity)
+	return ev
+}
+
+// CloudTrailSource reads real IAM events from one of two CloudTrail
+// delivery mechanisms: an S3 bucket receiving .json.gz log files
+// (notified via SQS) or a CloudWatch Logs group fed by a CloudTrail
+// trail. Exactly one of the two backing readers is non-nil.
+type CloudTrailSource struct {
+	s3Reader *s3NotificationReader
+	cwReader *cloudWatchLogsReader
+
+	queue []IAMEvent
+}
+
+// NewCloudTrailSource picks an S3/SQS or CloudWatch Logs backing reader
+// based on CLOUDTRAIL_SOURCE_MODE and wires it up from these
+// environment variables:
+//
+//	CLOUDTRAIL_SOURCE_MODE   = "s3" | "cloudwatch"
+//	AWS_PROFILE              (optional, passed through to the SDK config loader)
+//
+//	s3 mode:
+//	  CLOUDTRAIL_SQS_QUEUE_URL
+//	  CLOUDTRAIL_S3_BUCKET     (sanity-checked against the notification's bucket)
+//
+//	cloudwatch mode:
+//	  CLOUDTRAIL_LOG_GROUP
+//	  CLOUDTRAIL_CURSOR_FILE   (optional, default "cloudtrail-cursor.txt";
+//	                            persists the dedup cursor across restarts)
+func NewCloudTrailSource(ctx context.Context) (*CloudTrailSource, error) {
+	mode := getEnvOrFail("CLOUDTRAIL_SOURCE_MODE")
+
+	var optFns []func(*config.LoadOptions) error
+	if profile := getEnvOrDefault("AWS_PROFILE", ""); profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	switch mode {
+	case "s3":
+		return &CloudTrailSource{s3Reader: &s3NotificationReader{
+			s3:         s3.NewFromConfig(cfg),
+			sqs:        sqs.NewFromConfig(cfg),
+			queueURL:   getEnvOrFail("CLOUDTRAIL_SQS_QUEUE_URL"),
+			wantBucket: getEnvOrDefault("CLOUDTRAIL_S3_BUCKET", ""),
+		}}, nil
+	case "cloudwatch":
+		cursorPath := getEnvOrDefault("CLOUDTRAIL_CURSOR_FILE", "cloudtrail-cursor.txt")
+		lastSeenMS, err := loadCursor(cursorPath)
+		if err != nil {
+			return nil, fmt.Errorf("load cloudwatch cursor %s: %w", cursorPath, err)
+		}
+		return &CloudTrailSource{cwReader: &cloudWatchLogsReader{
+			logs:       cloudwatchlogs.NewFromConfig(cfg),
+			logGroup:   getEnvOrFail("CLOUDTRAIL_LOG_GROUP"),
+			cursorPath: cursorPath,
+			lastSeenMS: lastSeenMS,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown CLOUDTRAIL_SOURCE_MODE %q (want \"s3\" or \"cloudwatch\")", mode)
+	}
+}
+
+func (c *CloudTrailSource) Next(ctx context.Context) (IAMEvent, error) {
+	for len(c.queue) == 0 {
+		var (
+			batch []IAMEvent
+			err   error
+		)
+		if c.s3Reader != nil {
+			batch, err = c.s3Reader.poll(ctx)
+		} else {
+			batch, err = c.cwReader.poll(ctx)
+		}
+		if err != nil {
+			return IAMEvent{}, err
+		}
+		c.queue = append(c.queue, batch...)
+	}
+
+	ev := c.queue[0]
+	c.queue = c.queue[1:]
+	return ev, nil
+}
+
+// s3NotificationReader long-polls an SQS queue for S3 ObjectCreated
+// notifications, fetches the referenced .json.gz CloudTrail delivery,
+// and decodes every record inside it.
+type s3NotificationReader struct {
+	s3         *s3.Client
+	sqs        *sqs.Client
+	queueURL   string
+	wantBucket string
+}
+
+type s3EventNotification struct {
+	Records []struct {
+		S3 struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+func (r *s3NotificationReader) poll(ctx context.Context) ([]IAMEvent, error) {
+	out, err := r.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(r.queueURL),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("receive SQS message: %w", err)
+	}
+
+	var events []IAMEvent
+	for _, msg := range out.Messages {
+		var notif s3EventNotification
+		if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &notif); err != nil {
+			// Not an S3 event notification we recognize (e.g. the
+			// s3:TestEvent S3 sends when a bucket notification is first
+			// configured). Delete it anyway, or it sits in the queue
+			// until its visibility timeout elapses and comes back
+			// forever, poisoning every poll from here on.
+			if err := r.deleteMessage(ctx, msg.ReceiptHandle); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, rec := range notif.Records {
+			if r.wantBucket != "" && rec.S3.Bucket.Name != r.wantBucket {
+				continue
+			}
+			batch, err := r.fetchDelivery(ctx, rec.S3.Bucket.Name, rec.S3.Object.Key)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, batch...)
+		}
+
+		if err := r.deleteMessage(ctx, msg.ReceiptHandle); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (r *s3NotificationReader) deleteMessage(ctx context.Context, receiptHandle *string) error {
+	_, err := r.sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(r.queueURL),
+		ReceiptHandle: receiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("delete SQS message: %w", err)
+	}
+	return nil
+}
+
+func (r *s3NotificationReader) fetchDelivery(ctx context.Context, bucket, key string) ([]IAMEvent, error) {
+	obj, err := r.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get s3 object s3://%s/%s: %w", bucket, key, err)
+	}
+	defer obj.Body.Close()
+
+	gz, err := gzip.NewReader(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip s3://%s/%s: %w", bucket, key, err)
+	}
+	defer gz.Close()
+
+	var delivery struct {
+		Records []json.RawMessage `json:"Records"`
+	}
+	if err := json.NewDecoder(gz).Decode(&delivery); err != nil {
+		return nil, fmt.Errorf("decode cloudtrail delivery s3://%s/%s: %w", bucket, key, err)
+	}
+
+	events := make([]IAMEvent, 0, len(delivery.Records))
+	for _, raw := range delivery.Records {
+		var rec cloudTrailRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			continue
+		}
+		var asMap map[string]interface{}
+		_ = json.Unmarshal(raw, &asMap)
+		events = append(events, rec.toIAMEvent(asMap))
+	}
+	return events, nil
+}
+
+// cloudWatchLogsReader polls a CloudTrail-fed log group with
+// FilterLogEvents, tracking the last seen timestamp so repeated polls
+// don't re-deliver the same events. lastSeenMS is persisted to
+// cursorPath after every poll so a process restart resumes from where
+// it left off instead of replaying (or re-skipping) the last 5 minutes.
+type cloudWatchLogsReader struct {
+	logs       *cloudwatchlogs.Client
+	logGroup   string
+	cursorPath string
+	lastSeenMS int64
+}
+
+// loadCursor reads a previously persisted lastSeenMS from path. A
+// missing file is not an error: it just means there's no cursor yet
+// (first run, or persistence disabled).
+func loadCursor(path string) (int64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse cursor: %w", err)
+	}
+	return ms, nil
+}
+
+// saveCursor persists lastSeenMS to path so the next process restart
+// can resume from it. Failures are returned for the caller to log, but
+// are not fatal to the poll that produced the new value.
+func saveCursor(path string, ms int64) error {
+	return os.WriteFile(path, []byte(strconv.FormatInt(ms, 10)), 0o644)
+}
+
+func (r *cloudWatchLogsReader) poll(ctx context.Context) ([]IAMEvent, error) {
+	start := r.lastSeenMS
+	if start == 0 {
+		start = time.Now().Add(-5 * time.Minute).UnixMilli()
+	}
+
+	var (
+		events    []IAMEvent
+		highestMS int64
+		token     *string
+	)
+	for {
+		out, err := r.logs.FilterLogEvents(ctx, &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName: aws.String(r.logGroup),
+			StartTime:    aws.Int64(start + 1),
+			NextToken:    token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("filter log events on %s: %w", r.logGroup, err)
+		}
+
+		for _, le := range out.Events {
+			msg := aws.ToString(le.Message)
+			var rec cloudTrailRecord
+			if err := json.Unmarshal([]byte(msg), &rec); err != nil {
+				continue
+			}
+			var asMap map[string]interface{}
+			_ = json.Unmarshal([]byte(msg), &asMap)
+			events = append(events, rec.toIAMEvent(asMap))
+
+			if ts := aws.ToInt64(le.Timestamp); ts > highestMS {
+				highestMS = ts
+			}
+		}
+
+		if out.NextToken == nil {
+			break
+		}
+		token = out.NextToken
+	}
+
+	// Only advance the dedup cursor once every page for this poll has
+	// been consumed, so a NextToken error partway through a large
+	// window can't cause events past it to be skipped on retry.
+	if highestMS > r.lastSeenMS {
+		r.lastSeenMS = highestMS
+		if r.cursorPath != "" {
+			if err := saveCursor(r.cursorPath, r.lastSeenMS); err != nil {
+				fmt.Printf("warning: failed to persist cloudwatch cursor to %s: %v\n", r.cursorPath, err)
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		time.Sleep(5 * time.Second) // avoid hammering FilterLogEvents while idle
+	}
+	return events, nil
+}
+
+// getEnvOrDefault is the non-fatal counterpart to getEnvOrFail, for
+// variables that are genuinely optional.
+func getEnvOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	hecMaxBatchBytes = 1 << 20 // 1MB
+	hecMaxBatchAge   = 2 * time.Second
+	hecMaxRetries    = 5
+	hecBaseBackoff   = 500 * time.Millisecond
+	hecMaxBackoff    = 30 * time.Second
+)
+
+// HECClient batches IAMEvents, gzip-compresses and ships them to Splunk
+// HEC, optionally waiting on indexer acknowledgment, retrying transient
+// failures with backoff, and writing permanently-failed batches to a
+// dead-letter file for later replay.
+//
+// Events are submitted with Send and flushed either when the pending
+// batch reaches hecMaxBatchBytes or hecMaxBatchAge elapses, whichever
+// comes first. Send blocks when a flush is already in flight, which is
+// what keeps a slow HEC from letting the buffer grow without bound.
+type HECClient struct {
+	client   *http.Client
+	hecURL   string
+	hecToken string
+	useAck   bool
+	dlqPath  string
+
+	mu      sync.Mutex
+	pending []byte
+	count   int
+	timer   *time.Timer
+}
+
+// NewHECClient takes the HEC URL/token directly (the caller resolves
+// those per-sink) but reads its own optional behavior from the
+// environment:
+//
+//	PIPELINE_HEC_USE_ACK     = "true" to enable indexer acknowledgment (default "false")
+//	PIPELINE_HEC_DLQ_FILE    path to the dead-letter JSONL file (default "hec-dlq.jsonl")
+func NewHECClient(client *http.Client, hecURL, hecToken string) *HECClient {
+	return &HECClient{
+		client:   client,
+		hecURL:   hecURL,
+		hecToken: hecToken,
+		useAck:   getEnvOrDefault("PIPELINE_HEC_USE_ACK", "false") == "true",
+		dlqPath:  getEnvOrDefault("PIPELINE_HEC_DLQ_FILE", "hec-dlq.jsonl"),
+	}
+}
+
+// Send appends event to the pending batch, flushing synchronously (and
+// blocking the caller) if the batch is already full. This is what makes
+// the client back-pressure aware: a caller producing faster than HEC can
+// absorb will stall in Send rather than buffering unboundedly.
+func (c *HECClient) Send(ctx context.Context, index, sourcetype string, event IAMEvent) error {
+	payload := HECEvent{
+		Time:       time.Now().Unix(),
+		Index:      index,
+		SourceType: sourcetype,
+		Event:      event,
+	}
+	line, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	if c.timer == nil {
+		c.timer = time.AfterFunc(hecMaxBatchAge, func() { c.Flush(ctx) })
+	}
+	if len(c.pending)+len(line) > hecMaxBatchBytes && len(c.pending) > 0 {
+		batch := c.takeBatchLocked()
+		c.mu.Unlock()
+		if err := c.sendBatch(ctx, batch); err != nil {
+			return err
+		}
+		c.mu.Lock()
+	}
+	c.pending = append(c.pending, line...)
+	c.count++
+	c.mu.Unlock()
+	return nil
+}
+
+// Flush ships whatever is currently pending, if anything. It is called
+// both by the batch-age timer and explicitly before shutdown.
+func (c *HECClient) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	batch := c.takeBatchLocked()
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return c.sendBatch(ctx, batch)
+}
+
+// takeBatchLocked must be called with c.mu held. It resets the pending
+// buffer and batch-age timer and returns what had accumulated.
+func (c *HECClient) takeBatchLocked() []byte {
+	batch := c.pending
+	c.pending = nil
+	c.count = 0
+	if c.timer != nil {
+		c.timer.Reset(hecMaxBatchAge)
+	}
+	return batch
+}
+
+// sendBatch delivers batch with retry/backoff and, if every attempt
+// fails, writes it to the dead-letter file so it can be replayed later.
+func (c *HECClient) sendBatch(ctx context.Context, batch []byte) error {
+	lastErr := c.sendWithRetry(ctx, batch)
+	if lastErr == nil {
+		return nil
+	}
+
+	if writeErr := c.writeDeadLetter(batch); writeErr != nil {
+		return fmt.Errorf("send batch failed (%v) and dead-letter write failed: %w", lastErr, writeErr)
+	}
+	return fmt.Errorf("send batch failed after retries, wrote to dead-letter file %s: %w", c.dlqPath, lastErr)
+}
+
+// sendWithRetry delivers batch with retry/backoff and reports the last
+// error if every attempt fails, without touching the dead-letter file.
+func (c *HECClient) sendWithRetry(ctx context.Context, batch []byte) error {
+	gzBody, err := gzipEncode(batch)
+	if err != nil {
+		return fmt.Errorf("gzip batch: %w", err)
+	}
+
+	var channel string
+	if c.useAck {
+		channel = newRequestChannel()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= hecMaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithBackoff(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		ackID, err := c.postBatch(ctx, gzBody, channel)
+		if err != nil {
+			lastErr = err
+			if !isRetryableHECErr(err) {
+				break
+			}
+			continue
+		}
+
+		if !c.useAck {
+			return nil
+		}
+		// The POST already landed, so HEC has indexed this batch: a
+		// failure polling for its ack (network blip, ctx deadline,
+		// malformed response) must not fall through to another
+		// postBatch call above, or the same events get indexed twice.
+		// pollAck retries transient failures against this same ackID
+		// internally, so whatever it returns here is final.
+		return c.pollAck(ctx, channel, ackID)
+	}
+	return lastErr
+}
+
+// hecStatusError carries the HTTP status so retry logic can distinguish
+// transient (5xx/429) from permanent failures.
+type hecStatusError struct {
+	status int
+}
+
+func (e *hecStatusError) Error() string {
+	return fmt.Sprintf("non-200 from Splunk HEC: %d", e.status)
+}
+
+func isRetryableHECErr(err error) bool {
+	var statusErr *hecStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status == http.StatusTooManyRequests || statusErr.status >= 500
+	}
+	// Network-level errors (no status at all) are treated as transient.
+	return true
+}
+
+func (c *HECClient) postBatch(ctx context.Context, gzBody []byte, channel string) (ackID string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.hecURL, bytes.NewReader(gzBody))
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Splunk "+c.hecToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", channel)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &hecStatusError{status: resp.StatusCode}
+	}
+
+	if channel == "" {
+		return "", nil
+	}
+
+	var ackResp struct {
+		AckID int64 `json:"ackId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ackResp); err != nil {
+		return "", fmt.Errorf("decode ack id: %w", err)
+	}
+	return strconv.FormatInt(ackResp.AckID, 10), nil
+}
+
+// pollAck polls /services/collector/ack until ackID is acknowledged or
+// ctx is cancelled, per Splunk's indexer acknowledgment protocol. The
+// batch behind ackID was already accepted by HEC, so a failure on any
+// one poll (a network blip, a malformed response) is treated as
+// transient and retried in place here, up to hecMaxRetries consecutive
+// failures — it must never cause the caller to re-POST the batch.
+func (c *HECClient) pollAck(ctx context.Context, channel, ackID string) error {
+	body, err := json.Marshal(map[string][]string{"acks": {ackID}})
+	if err != nil {
+		return fmt.Errorf("marshal ack query: %w", err)
+	}
+
+	ackURL := c.hecURL + "/services/collector/ack"
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var consecutiveFailures int
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, ackURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("create ack request: %w", err)
+		}
+		req.Header.Set("Authorization", "Splunk "+c.hecToken)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Splunk-Request-Channel", channel)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if consecutiveFailures++; consecutiveFailures > hecMaxRetries {
+				return fmt.Errorf("poll ack: %w", err)
+			}
+			continue
+		}
+
+		var ackStatus struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		decErr := json.NewDecoder(resp.Body).Decode(&ackStatus)
+		resp.Body.Close()
+		if decErr != nil {
+			if consecutiveFailures++; consecutiveFailures > hecMaxRetries {
+				return fmt.Errorf("decode ack status: %w", decErr)
+			}
+			continue
+		}
+
+		consecutiveFailures = 0
+		if ackStatus.Acks[ackID] {
+			return nil
+		}
+	}
+}
+
+func (c *HECClient) writeDeadLetter(batch []byte) error {
+	f, err := os.OpenFile(c.dlqPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(batch)
+	return err
+}
+
+// ReplayDeadLetter re-sends every batch recorded in the dead-letter
+// file, one HEC-event line at a time, and truncates the file once every
+// line has been accepted. It backs the binary's --replay mode.
+func (c *HECClient) ReplayDeadLetter(ctx context.Context) error {
+	f, err := os.Open(c.dlqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open dead-letter file: %w", err)
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), hecMaxBatchBytes*2)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		lines = append(lines, line)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan dead-letter file: %w", err)
+	}
+
+	// sendWithRetry (unlike sendBatch) never writes to the dead-letter
+	// file itself, so it's untouched until every attempt below has run;
+	// only the batches still failing get written back.
+	var failed [][]byte
+	for _, line := range lines {
+		if err := c.sendWithRetry(ctx, append(line, '\n')); err != nil {
+			failed = append(failed, line)
+		}
+	}
+
+	if len(failed) == 0 {
+		// Prefer removing the file outright; if that fails (e.g. the
+		// process can write the file but not its parent directory),
+		// emptying it via truncate only needs file-level permission.
+		if err := os.Remove(c.dlqPath); err != nil {
+			if truncErr := os.Truncate(c.dlqPath, 0); truncErr != nil {
+				return fmt.Errorf("clear dead-letter file after successful replay: %w", truncErr)
+			}
+		}
+		return nil
+	}
+
+	f2, err := os.OpenFile(c.dlqPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("rewrite dead-letter file: %w", err)
+	}
+	defer f2.Close()
+	for _, line := range failed {
+		if _, err := f2.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("rewrite dead-letter file: %w", err)
+		}
+	}
+	return fmt.Errorf("replay: %d/%d dead-lettered batches failed again", len(failed), len(lines))
+}
+
+func gzipEncode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newRequestChannel() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
+		rand.Uint32(), rand.Uint32()&0xffff, rand.Uint32()&0xffff,
+		rand.Uint32()&0xffff, rand.Uint64()&0xffffffffffff)
+}
+
+// sleepWithBackoff waits an exponentially growing, jittered duration
+// before the given (1-indexed) retry attempt, or returns ctx.Err() if
+// ctx is cancelled first.
+func sleepWithBackoff(ctx context.Context, attempt int) error {
+	backoff := hecBaseBackoff * time.Duration(1<<uint(attempt-1))
+	if backoff > hecMaxBackoff {
+		backoff = hecMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+	wait := backoff/2 + jitter
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chris-mason/cloud-security-pipeline/hectest"
+)
+
+func testEvent(actor string) IAMEvent {
+	return IAMEvent{
+		Source:    "aws_cloudtrail",
+		Category:  "iam",
+		Action:    "CreateAccessKey",
+		Actor:     actor,
+		Target:    "new_user123",
+		Severity:  "high",
+		Timestamp: "2024-01-01T00:00:00Z",
+		Raw:       map[string]interface{}{"event_id": 1},
+	}
+}
+
+func newTestHECClient(t *testing.T, srv *hectest.Server) *HECClient {
+	t.Helper()
+	dlq := filepath.Join(t.TempDir(), "dlq.jsonl")
+	t.Setenv("PIPELINE_HEC_DLQ_FILE", dlq)
+	return NewHECClient(srv.Client(), srv.URL, "test-token")
+}
+
+func TestHECClientSendAndFlush(t *testing.T) {
+	cases := []struct {
+		name string
+	}{
+		{name: "single batch, happy path"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := hectest.NewServer("test-token")
+			defer srv.Close()
+
+			client := newTestHECClient(t, srv)
+			ctx := context.Background()
+
+			if err := client.Send(ctx, "cloud_security", "json", testEvent("unknown_user")); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if err := client.Flush(ctx); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+
+			if got := srv.Count(); got != 1 {
+				t.Fatalf("Count() = %d, want 1", got)
+			}
+			if got := srv.EventsByActor("unknown_user"); len(got) != 1 {
+				t.Fatalf("EventsByActor(unknown_user) = %d events, want 1", len(got))
+			}
+		})
+	}
+}
+
+func TestHECClientRetriesTransientFailures(t *testing.T) {
+	srv := hectest.NewServer("test-token")
+	defer srv.Close()
+	srv.FailServiceUnavailable(1, 0) // first request 503s, second succeeds
+
+	client := newTestHECClient(t, srv)
+	ctx := context.Background()
+
+	if err := client.Send(ctx, "cloud_security", "json", testEvent("dev_user1")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("Flush should succeed after retrying past the 503: %v", err)
+	}
+
+	if got := srv.RequestCount(); got != 2 {
+		t.Fatalf("RequestCount() = %d, want 2 (one 503 + one success)", got)
+	}
+	if got := srv.Count(); got != 1 {
+		t.Fatalf("Count() = %d, want 1", got)
+	}
+}
+
+func TestHECClientDeadLettersPermanentFailures(t *testing.T) {
+	srv := hectest.NewServer("test-token")
+	defer srv.Close()
+	srv.FailUnauthorized(true) // non-retryable: every attempt fails
+
+	dlq := filepath.Join(t.TempDir(), "dlq.jsonl")
+	t.Setenv("PIPELINE_HEC_DLQ_FILE", dlq)
+	client := NewHECClient(srv.Client(), srv.URL, "test-token")
+	ctx := context.Background()
+
+	if err := client.Send(ctx, "cloud_security", "json", testEvent("admin_user")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := client.Flush(ctx); err == nil {
+		t.Fatal("Flush should return an error when HEC rejects the batch outright")
+	}
+
+	if _, err := os.Stat(dlq); err != nil {
+		t.Fatalf("expected dead-letter file at %s: %v", dlq, err)
+	}
+	if srv.Count() != 0 {
+		t.Fatalf("server recorded %d events, want 0 (request was rejected)", srv.Count())
+	}
+
+	// Fix the server and replay: the dead-lettered batch should now land.
+	srv.FailUnauthorized(false)
+	if err := client.ReplayDeadLetter(ctx); err != nil {
+		t.Fatalf("ReplayDeadLetter: %v", err)
+	}
+	if got := srv.EventsByActor("admin_user"); len(got) != 1 {
+		t.Fatalf("EventsByActor(admin_user) after replay = %d events, want 1", len(got))
+	}
+	if _, err := os.Stat(dlq); !os.IsNotExist(err) {
+		t.Fatalf("dead-letter file should be removed after a fully successful replay, stat err: %v", err)
+	}
+}
+
+func TestHECClientFlushTimesOutAgainstSlowServer(t *testing.T) {
+	srv := hectest.NewServer("test-token")
+	defer srv.Close()
+	srv.SetSlow(2 * time.Second)
+
+	client := newTestHECClient(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := client.Send(ctx, "cloud_security", "json", testEvent("dev_user2")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Flush(ctx) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Flush should return an error when the server is too slow to respond within ctx's deadline")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Flush did not return promptly once ctx was cancelled against a slow server")
+	}
+}
+
+func TestHECClientIndexerAck(t *testing.T) {
+	srv := hectest.NewServer("test-token")
+	defer srv.Close()
+	srv.EnableAck(2) // acknowledged on the 2nd poll
+
+	t.Setenv("PIPELINE_HEC_USE_ACK", "true")
+	client := newTestHECClient(t, srv)
+	ctx := context.Background()
+
+	if err := client.Send(ctx, "cloud_security", "json", testEvent("security_engineer")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Flush(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Flush did not complete waiting for indexer ack")
+	}
+
+	if got := srv.EventsByActor("security_engineer"); len(got) != 1 {
+		t.Fatalf("EventsByActor(security_engineer) = %d events, want 1", len(got))
+	}
+}
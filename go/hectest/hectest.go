@@ -0,0 +1,266 @@
+// Package hectest provides an in-process mock of the Splunk HEC surface
+// this pipeline talks to, so the ingestion code can be exercised in CI
+// without a live Splunk instance.
+package hectest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RecordedEvent mirrors the wire shape the pipeline POSTs to HEC. It is
+// defined independently of the pipeline's own HECEvent/IAMEvent types so
+// this package has no import-cycle dependency on package main.
+type RecordedEvent struct {
+	Time       int64                  `json:"time"`
+	Index      string                 `json:"index"`
+	SourceType string                 `json:"sourcetype"`
+	Event      map[string]interface{} `json:"event"`
+}
+
+func (e RecordedEvent) actor() string {
+	actor, _ := e.Event["actor"].(string)
+	return actor
+}
+
+// Server is an httptest.Server that accepts HEC event submissions
+// (single-event or newline-delimited batches, gzip-encoded or not),
+// validates the bearer token, and can simulate the failure modes the
+// pipeline's retry/ack/DLQ logic needs to be tested against.
+type Server struct {
+	*httptest.Server
+
+	token string
+
+	mu               sync.Mutex
+	events           []RecordedEvent
+	requestCount     int
+	failUnauthorized bool
+	failCount        int // requests remaining to answer with 503
+	retryAfter       time.Duration
+	slowDelay        time.Duration
+
+	useAck     bool
+	ackPolls   int // poll cycles an ack needs before flipping to acknowledged
+	nextAckID  int64
+	acksRemain map[string]int
+}
+
+// NewServer starts a mock HEC server that requires the given token on
+// every request.
+func NewServer(token string) *Server {
+	s := &Server{token: token, acksRemain: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Count returns the number of individual events recorded so far.
+func (s *Server) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+// EventsByActor returns every recorded event whose "actor" field matches
+// the given name, in receipt order.
+func (s *Server) EventsByActor(actor string) []RecordedEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []RecordedEvent
+	for _, ev := range s.events {
+		if ev.actor() == actor {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// RequestCount returns how many HTTP requests have hit the server,
+// including ones that were answered with a failure status.
+func (s *Server) RequestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestCount
+}
+
+// FailUnauthorized makes every subsequent request fail with 401, as if
+// the HEC token were wrong. This is a permanent, non-retryable failure
+// mode until cleared (by constructing a new Server).
+func (s *Server) FailUnauthorized(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failUnauthorized = fail
+}
+
+// FailServiceUnavailable answers the next n requests with 503 and the
+// given Retry-After duration, then resumes normal handling.
+func (s *Server) FailServiceUnavailable(n int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failCount = n
+	s.retryAfter = retryAfter
+}
+
+// SetSlow makes every response wait delay before being written, to
+// exercise client-side timeouts.
+func (s *Server) SetSlow(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slowDelay = delay
+}
+
+// EnableAck switches the server into indexer-acknowledgment mode: POSTs
+// are answered with an ackId, and that ackId only shows up as
+// acknowledged on the pollsUntilAcked'th call to /services/collector/ack
+// (1 means "acknowledged on the first poll").
+func (s *Server) EnableAck(pollsUntilAcked int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.useAck = true
+	s.ackPolls = pollsUntilAcked
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requestCount++
+	slow := s.slowDelay
+	s.mu.Unlock()
+
+	if slow > 0 {
+		time.Sleep(slow)
+	}
+
+	if r.URL.Path == "/services/collector/ack" {
+		s.handleAckPoll(w, r)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth != "Splunk "+s.token {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	if s.failUnauthorized {
+		s.mu.Unlock()
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if s.failCount > 0 {
+		s.failCount--
+		retryAfter := s.retryAfter
+		s.mu.Unlock()
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		}
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	useAck := s.useAck
+	s.mu.Unlock()
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.NopCloser(gz)
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	events, err := parseEvents(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, events...)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !useAck {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"text":"Success","code":0}`))
+		return
+	}
+
+	s.mu.Lock()
+	s.nextAckID++
+	ackID := s.nextAckID
+	s.acksRemain[strconv.FormatInt(ackID, 10)] = s.ackPolls
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]int64{"ackId": ackID})
+}
+
+func (s *Server) handleAckPoll(w http.ResponseWriter, r *http.Request) {
+	var query struct {
+		Acks []string `json:"acks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, fmt.Sprintf("bad ack query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	result := make(map[string]bool, len(query.Acks))
+	for _, id := range query.Acks {
+		remaining, ok := s.acksRemain[id]
+		if !ok {
+			result[id] = false
+			continue
+		}
+		if remaining > 1 {
+			s.acksRemain[id] = remaining - 1
+			result[id] = false
+		} else {
+			s.acksRemain[id] = 0
+			result[id] = true
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]map[string]bool{"acks": result})
+}
+
+// parseEvents accepts both a single JSON object and newline-delimited
+// batches of them, matching what HECClient (and the original sendEvent)
+// can produce.
+func parseEvents(raw []byte) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+	scanner := bytes.Split(bytes.TrimSpace(raw), []byte("\n"))
+	for _, line := range scanner {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var ev RecordedEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return nil, fmt.Errorf("decode HEC event: %w", err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
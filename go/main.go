@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -23,10 +22,10 @@ type IAMEvent struct {
 }
 
 type HECEvent struct {
-	Time       int64     `json:"time"`
-	Index      string    `json:"index"`
-	SourceType string    `json:"sourcetype"`
-	Event      IAMEvent  `json:"event"`
+	Time       int64    `json:"time"`
+	Index      string   `json:"index"`
+	SourceType string   `json:"sourcetype"`
+	Event      IAMEvent `json:"event"`
 }
 
 func getEnvOrFail(key string) string {
@@ -38,15 +37,21 @@ func getEnvOrFail(key string) string {
 	return val
 }
 
-func buildClient() *http.Client {
-	// Skip TLS verification for the lab (self-signed Splunk cert)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // lab-only!
+func buildClient() (*http.Client, error) {
+	builder, err := NewTLSConfigBuilder()
+	if err != nil {
+		return nil, fmt.Errorf("build TLS config: %w", err)
+	}
+	tlsConfig, err := builder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("build TLS config: %w", err)
 	}
+
+	tr := &http.Transport{TLSClientConfig: tlsConfig}
 	return &http.Client{
 		Transport: tr,
 		Timeout:   10 * time.Second,
-	}
+	}, nil
 }
 
 func generateFakeIAMEvent() IAMEvent {
@@ -84,9 +89,7 @@ func generateFakeIAMEvent() IAMEvent {
 	sevIndex := rand.Intn(len(severities))
 	severity := severities[sevIndex]
 
-	if actor == "unknown_user" || action == "DeleteUser" || action == "CreateAccessKey" {
-		severity = "high"
-	}
+	severity = elevatedSeverity(actor, action, severity)
 
 	return IAMEvent{
 		Source:    "aws_cloudtrail",
@@ -103,64 +106,134 @@ func generateFakeIAMEvent() IAMEvent {
 	}
 }
 
-func sendEvent(client *http.Client, hecURL, hecToken, index, sourcetype string, event IAMEvent) error {
-	payload := HECEvent{
-		Time:       time.Now().Unix(),
-		Index:      index,
-		SourceType: sourcetype,
-		Event:      event,
+// newEventSource picks the event source implementation based on
+// PIPELINE_EVENT_SOURCE (default "fake" keeps today's behavior).
+func newEventSource(ctx context.Context) (EventSource, error) {
+	switch getEnvOrDefault("PIPELINE_EVENT_SOURCE", "fake") {
+	case "fake":
+		return FakeSource{}, nil
+	case "cloudtrail":
+		return NewCloudTrailSource(ctx)
+	default:
+		return nil, fmt.Errorf("unknown PIPELINE_EVENT_SOURCE %q", os.Getenv("PIPELINE_EVENT_SOURCE"))
 	}
+}
 
-	body, err := json.Marshal(payload)
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	replay := flag.Bool("replay", false, "replay the HEC dead-letter file instead of generating events")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	client, err := buildClient()
 	if err != nil {
-		return fmt.Errorf("marshal payload: %w", err)
+		fmt.Println("Error building HTTP client:", err)
+		os.Exit(1)
 	}
 
-	req, err := http.NewRequest("POST", hecURL, bytes.NewBuffer(body))
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+	if *replay {
+		// Replaying the dead-letter file always talks to HEC directly, so
+		// unlike the sink-fanout path below, credentials are required
+		// unconditionally here.
+		hecURL := getEnvOrFail("SPLUNK_HEC_URL")
+		hecToken := getEnvOrFail("SPLUNK_HEC_TOKEN")
+		if err := NewHECClient(client, hecURL, hecToken).ReplayDeadLetter(ctx); err != nil {
+			fmt.Println("Error replaying dead-letter file:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Dead-letter file replayed successfully.")
+		return
 	}
-	req.Header.Set("Authorization", "Splunk "+hecToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	alertIndex := getEnvOrDefault("PIPELINE_POLICY_ALERT_INDEX", "")
+	dropDisallowed := getEnvOrDefault("PIPELINE_POLICY_DROP_DISALLOWED", "false") == "true"
+
+	// SPLUNK_HEC_URL/TOKEN are only actually needed if a sink ends up
+	// using them, which LoadSinks resolves; deployments that disable the
+	// "hec" sink in PIPELINE_SINKS_CONFIG shouldn't need to set them.
+	hecURL := getEnvOrDefault("SPLUNK_HEC_URL", "")
+	hecToken := getEnvOrDefault("SPLUNK_HEC_TOKEN", "")
+
+	sinks, err := LoadSinks(ctx, client, hecURL, hecToken)
 	if err != nil {
-		return fmt.Errorf("send request: %w", err)
+		fmt.Println("Error configuring sinks:", err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
+	sink := NewFanOutSink(sinks)
+	defer func() {
+		if err := sink.Close(); err != nil {
+			fmt.Println("Error closing sinks:", err)
+		}
+	}()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-200 from Splunk: %s", resp.Status)
+	source, err := newEventSource(ctx)
+	if err != nil {
+		fmt.Println("Error building event source:", err)
+		os.Exit(1)
 	}
 
-	fmt.Println("Status:", resp.Status)
-	return nil
-}
-
-func main() {
-	rand.Seed(time.Now().UnixNano())
-
-	hecURL := getEnvOrFail("SPLUNK_HEC_URL")
-	hecToken := getEnvOrFail("SPLUNK_HEC_TOKEN")
+	policy, err := NewPolicyEvaluator()
+	if err != nil {
+		fmt.Println("Error building policy evaluator:", err)
+		os.Exit(1)
+	}
 
-	// For now we hardcode these just like the Python script.
-	index := "cloud_security"
-	sourcetype := "json"
+	// FakeSource is a demo generator with no natural stopping point or
+	// pacing of its own, so it gets a bounded run and an artificial
+	// delay between events. Real sources (CloudTrailSource) already
+	// pace themselves (SQS long-polling, idle backoff in
+	// cloudWatchLogsReader.poll) and should run as genuine continuous
+	// ingestion until ctx is cancelled or the source errors out.
+	_, demo := source.(FakeSource)
+
+	numEvents := 0 // 0 means unbounded
+	if demo {
+		numEvents = 20
+		fmt.Printf("Sending %d IAM events from Go to Splunk...\n", numEvents)
+	} else {
+		fmt.Println("Ingesting IAM events from Go to Splunk...")
+	}
 
-	client := buildClient()
+	for i := 0; numEvents == 0 || i < numEvents; i++ {
+		ev, err := source.Next(ctx)
+		if err != nil {
+			fmt.Println("Error reading event:", err)
+			break
+		}
 
-	numEvents := 20
-	fmt.Printf("Sending %d fake IAM events from Go to Splunk...\n", numEvents)
+		if policy != nil {
+			decision, err := policy.Evaluate(ctx, ev)
+			if err != nil {
+				fmt.Println("Error evaluating policy:", err)
+			} else {
+				ev = applyDecision(ev, decision)
+				if !decision.Allow {
+					if dropDisallowed {
+						fmt.Printf("[%d] dropped by policy: %s by %s -> %s\n",
+							i+1, ev.Action, ev.Actor, ev.Target)
+						continue
+					}
+					if alertIndex != "" {
+						if ev.Raw == nil {
+							ev.Raw = map[string]interface{}{}
+						}
+						ev.Raw[hecIndexOverrideKey] = alertIndex
+					}
+				}
+			}
+		}
 
-	for i := 0; i < numEvents; i++ {
-		ev := generateFakeIAMEvent()
-		fmt.Printf("[%d/%d] %s by %s -> %s (sev=%s)\n",
-			i+1, numEvents, ev.Action, ev.Actor, ev.Target, ev.Severity)
+		fmt.Printf("[%d] %s by %s -> %s (sev=%s)\n",
+			i+1, ev.Action, ev.Actor, ev.Target, ev.Severity)
 
-		if err := sendEvent(client, hecURL, hecToken, index, sourcetype, ev); err != nil {
-			fmt.Println("Error sending event:", err)
+		if err := sink.Write(ctx, []IAMEvent{ev}); err != nil {
+			fmt.Println("Error writing event to sinks:", err)
 		}
 
-		time.Sleep(200 * time.Millisecond)
+		if demo {
+			time.Sleep(200 * time.Millisecond)
+		}
 	}
 }
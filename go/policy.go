@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// policyDecision is the shape returned by the Rego policy, whichever way
+// it was evaluated: `data.<package>.decision`.
+type policyDecision struct {
+	Allow    bool     `json:"allow"`
+	Severity string   `json:"severity"`
+	Tags     []string `json:"tags"`
+	Reasons  []string `json:"reasons"`
+}
+
+// PolicyEvaluator scores an IAMEvent against an external OPA policy
+// before it reaches a sink. It overwrites Severity, appends Tags/Reasons
+// into Raw, and can drop disallowed events (or reroute them, see
+// DropDisallowed/AlertIndex on the caller side).
+type PolicyEvaluator struct {
+	// Exactly one of binaryPath or serverURL is set.
+	binaryPath string
+	policyPath string
+
+	serverURL  string
+	httpClient *http.Client
+
+	pkg string // e.g. "pipeline.iam", used for both modes
+}
+
+// NewPolicyEvaluator picks binary or server evaluation mode based on
+// PIPELINE_POLICY_MODE, returning a nil evaluator (and nil error) when
+// policy evaluation is disabled:
+//
+//	PIPELINE_POLICY_MODE = "binary" | "server" (absent/"none" disables policy evaluation)
+//	PIPELINE_POLICY_PACKAGE            (default "pipeline.iam")
+//
+//	binary mode:
+//	  PIPELINE_POLICY_OPA_BIN           (default "opa", resolved via PATH)
+//	  PIPELINE_POLICY_FILE              (default "policies/default.rego")
+//
+//	server mode:
+//	  PIPELINE_POLICY_SERVER_URL        (e.g. http://localhost:8181)
+func NewPolicyEvaluator() (*PolicyEvaluator, error) {
+	pkg := getEnvOrDefault("PIPELINE_POLICY_PACKAGE", "pipeline.iam")
+
+	switch getEnvOrDefault("PIPELINE_POLICY_MODE", "none") {
+	case "none":
+		return nil, nil
+	case "binary":
+		return &PolicyEvaluator{
+			binaryPath: getEnvOrDefault("PIPELINE_POLICY_OPA_BIN", "opa"),
+			policyPath: getEnvOrDefault("PIPELINE_POLICY_FILE", "policies/default.rego"),
+			pkg:        pkg,
+		}, nil
+	case "server":
+		return &PolicyEvaluator{
+			serverURL:  getEnvOrFail("PIPELINE_POLICY_SERVER_URL"),
+			httpClient: &http.Client{Timeout: 5 * time.Second},
+			pkg:        pkg,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown PIPELINE_POLICY_MODE %q (want \"none\", \"binary\" or \"server\")",
+			getEnvOrDefault("PIPELINE_POLICY_MODE", "none"))
+	}
+}
+
+// Evaluate runs the policy against ev and returns the decision. The
+// caller is responsible for applying it (overwrite Severity, append
+// tags/reasons, and honor Allow).
+func (p *PolicyEvaluator) Evaluate(ctx context.Context, ev IAMEvent) (policyDecision, error) {
+	if p.serverURL != "" {
+		return p.evaluateServer(ctx, ev)
+	}
+	return p.evaluateBinary(ctx, ev)
+}
+
+func (p *PolicyEvaluator) evaluateServer(ctx context.Context, ev IAMEvent) (policyDecision, error) {
+	path := "/v1/data/" + ruleRefToPath(p.pkg) + "/decision"
+	body, err := json.Marshal(map[string]interface{}{"input": ev})
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("marshal policy input: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.serverURL+path, bytes.NewReader(body))
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("build policy request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("call OPA server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return policyDecision{}, fmt.Errorf("non-200 from OPA server: %s", resp.Status)
+	}
+
+	var wrapped struct {
+		Result policyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&wrapped); err != nil {
+		return policyDecision{}, fmt.Errorf("decode OPA server response: %w", err)
+	}
+	return wrapped.Result, nil
+}
+
+func (p *PolicyEvaluator) evaluateBinary(ctx context.Context, ev IAMEvent) (policyDecision, error) {
+	input, err := json.Marshal(ev)
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("marshal policy input: %w", err)
+	}
+
+	query := "data." + p.pkg + ".decision"
+	cmd := exec.CommandContext(ctx, p.binaryPath, "eval",
+		"--data", p.policyPath,
+		"--stdin-input",
+		"--format", "json",
+		query,
+	)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return policyDecision{}, fmt.Errorf("opa eval: %w: %s", err, stderr.String())
+	}
+
+	var out struct {
+		Result []struct {
+			Expressions []struct {
+				Value policyDecision `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return policyDecision{}, fmt.Errorf("decode opa eval output: %w", err)
+	}
+	if len(out.Result) == 0 || len(out.Result[0].Expressions) == 0 {
+		return policyDecision{}, fmt.Errorf("opa eval returned no result for %s", query)
+	}
+	return out.Result[0].Expressions[0].Value, nil
+}
+
+// ruleRefToPath turns a dotted Rego package path like "pipeline.iam" into
+// the slash-separated form the OPA REST API expects.
+func ruleRefToPath(pkg string) string {
+	out := make([]byte, 0, len(pkg))
+	for i := 0; i < len(pkg); i++ {
+		if pkg[i] == '.' {
+			out = append(out, '/')
+		} else {
+			out = append(out, pkg[i])
+		}
+	}
+	return string(out)
+}
+
+// applyDecision overwrites ev's severity (if the policy returned one)
+// and folds tags/reasons into Raw, returning the updated event.
+func applyDecision(ev IAMEvent, d policyDecision) IAMEvent {
+	if d.Severity != "" {
+		ev.Severity = d.Severity
+	}
+	if ev.Raw == nil {
+		ev.Raw = map[string]interface{}{}
+	}
+	if len(d.Tags) > 0 {
+		ev.Raw["policy_tags"] = d.Tags
+	}
+	if len(d.Reasons) > 0 {
+		ev.Raw["policy_reasons"] = d.Reasons
+	}
+	return ev
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	kafka "github.com/segmentio/kafka-go"
+	"gopkg.in/yaml.v3"
+)
+
+// Sink is anywhere a batch of IAMEvents can be delivered. Write is
+// called with whatever events the caller has on hand; a sink owns its
+// own batching/retry policy internally.
+type Sink interface {
+	Write(ctx context.Context, events []IAMEvent) error
+	Close() error
+}
+
+// sinksFile is the on-disk shape of the sinks config, read from either
+// YAML or JSON (selected by PIPELINE_SINKS_CONFIG's file extension).
+type sinksFile struct {
+	Sinks []sinkConfig `yaml:"sinks" json:"sinks"`
+}
+
+type sinkConfig struct {
+	Type     string            `yaml:"type" json:"type"`
+	Enabled  bool              `yaml:"enabled" json:"enabled"`
+	Settings map[string]string `yaml:"settings" json:"settings"`
+}
+
+// LoadSinks reads PIPELINE_SINKS_CONFIG (default "sinks.yaml") and
+// builds every enabled sink it lists. If the file does not exist, it
+// falls back to the Splunk HEC sink alone, so the pipeline keeps
+// working unmodified for anyone who hasn't adopted the config file yet.
+// hecURL/hecToken may be passed in blank; they're only required (and
+// read from SPLUNK_HEC_URL/SPLUNK_HEC_TOKEN as a last resort) once an
+// actual "hec" sink needs them.
+func LoadSinks(ctx context.Context, client *http.Client, hecURL, hecToken string) ([]Sink, error) {
+	path := getEnvOrDefault("PIPELINE_SINKS_CONFIG", "sinks.yaml")
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if hecURL == "" {
+				hecURL = getEnvOrFail("SPLUNK_HEC_URL")
+			}
+			if hecToken == "" {
+				hecToken = getEnvOrFail("SPLUNK_HEC_TOKEN")
+			}
+			return []Sink{newHECSink(client, hecURL, hecToken)}, nil
+		}
+		return nil, fmt.Errorf("read sinks config %s: %w", path, err)
+	}
+
+	var file sinksFile
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(raw, &file)
+	} else {
+		err = yaml.Unmarshal(raw, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse sinks config %s: %w", path, err)
+	}
+
+	var sinks []Sink
+	for _, sc := range file.Sinks {
+		if !sc.Enabled {
+			continue
+		}
+		sink, err := buildSink(ctx, sc, client, hecURL, hecToken)
+		if err != nil {
+			return nil, fmt.Errorf("configure %s sink: %w", sc.Type, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no enabled sinks in %s", path)
+	}
+	return sinks, nil
+}
+
+func buildSink(ctx context.Context, sc sinkConfig, client *http.Client, hecURL, hecToken string) (Sink, error) {
+	switch sc.Type {
+	case "hec":
+		url := sc.Settings["url"]
+		if url == "" {
+			url = hecURL
+		}
+		if url == "" {
+			url = getEnvOrFail("SPLUNK_HEC_URL")
+		}
+		token := sc.Settings["token"]
+		if token == "" {
+			token = hecToken
+		}
+		if token == "" {
+			token = getEnvOrFail("SPLUNK_HEC_TOKEN")
+		}
+		return newHECSink(client, url, token), nil
+	case "elasticsearch":
+		return newElasticsearchSink(client, sc.Settings)
+	case "kafka":
+		return newKafkaSink(sc.Settings)
+	case "s3":
+		return newS3Sink(ctx, sc.Settings)
+	case "file":
+		return newFileSink(sc.Settings)
+	case "stdout":
+		return stdoutSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+	}
+}
+
+// FanOutSink writes to every configured sink concurrently. One sink
+// failing does not stop the others, and their errors are combined with
+// errors.Join so the caller can see (and log) all of them.
+type FanOutSink struct {
+	sinks []Sink
+}
+
+func NewFanOutSink(sinks []Sink) *FanOutSink {
+	return &FanOutSink{sinks: sinks}
+}
+
+func (f *FanOutSink) Write(ctx context.Context, events []IAMEvent) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(f.sinks))
+
+	for _, s := range f.sinks {
+		wg.Add(1)
+		go func(s Sink) {
+			defer wg.Done()
+			if err := s.Write(ctx, events); err != nil {
+				errCh <- fmt.Errorf("%T: %w", s, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errCh)
+
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (f *FanOutSink) Close() error {
+	var errs []error
+	for _, s := range f.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%T: %w", s, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hecIndexOverrideKey, when present in an IAMEvent's Raw map, tells
+// hecSink to route that one event to a different HEC index (used by
+// main's policy-alert-routing path) instead of the sink's default.
+const hecIndexOverrideKey = "_hec_index_override"
+
+// hecSink adapts the existing HECClient (index/sourcetype per event) to
+// the Sink interface, using the pipeline's default index/sourcetype.
+type hecSink struct {
+	client     *HECClient
+	index      string
+	sourcetype string
+}
+
+func newHECSink(httpClient *http.Client, hecURL, hecToken string) *hecSink {
+	return &hecSink{
+		client:     NewHECClient(httpClient, hecURL, hecToken),
+		index:      "cloud_security",
+		sourcetype: "json",
+	}
+}
+
+func (s *hecSink) Write(ctx context.Context, events []IAMEvent) error {
+	var errs []error
+	for _, ev := range events {
+		index := s.index
+		if override, ok := ev.Raw[hecIndexOverrideKey].(string); ok && override != "" {
+			index = override
+		}
+		if err := s.client.Send(ctx, index, s.sourcetype, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *hecSink) Close() error {
+	return s.client.Flush(context.Background())
+}
+
+// stdoutSink prints one JSON line per event, for local debugging.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(ctx context.Context, events []IAMEvent) error {
+	for _, ev := range events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		fmt.Println(string(line))
+	}
+	return nil
+}
+
+func (stdoutSink) Close() error { return nil }
+
+// elasticsearchSink writes events through the _bulk API, rolling over
+// to a new index each day (<prefix>-YYYY.MM.DD), which is the usual
+// Elasticsearch convention for time-series log indices.
+type elasticsearchSink struct {
+	client      *http.Client
+	url         string
+	indexPrefix string
+	username    string
+	password    string
+}
+
+func newElasticsearchSink(client *http.Client, settings map[string]string) (*elasticsearchSink, error) {
+	url := settings["url"]
+	if url == "" {
+		return nil, fmt.Errorf("elasticsearch sink requires a \"url\" setting")
+	}
+	prefix := settings["index_prefix"]
+	if prefix == "" {
+		prefix = "cloud-security"
+	}
+	return &elasticsearchSink{
+		client:      client,
+		url:         strings.TrimRight(url, "/"),
+		indexPrefix: prefix,
+		username:    settings["username"],
+		password:    settings["password"],
+	}, nil
+}
+
+func (s *elasticsearchSink) Write(ctx context.Context, events []IAMEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	index := fmt.Sprintf("%s-%s", s.indexPrefix, time.Now().UTC().Format("2006.01.02"))
+
+	var buf bytes.Buffer
+	for _, ev := range events {
+		action, err := json.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": index},
+		})
+		if err != nil {
+			return fmt.Errorf("marshal bulk action: %w", err)
+		}
+		doc, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/_bulk", &buf)
+	if err != nil {
+		return fmt.Errorf("create bulk request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send bulk request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 from Elasticsearch _bulk: %s", resp.Status)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decode bulk response: %w", err)
+	}
+	if result.Errors {
+		return fmt.Errorf("elasticsearch _bulk reported per-item errors for index %s", index)
+	}
+	return nil
+}
+
+func (s *elasticsearchSink) Close() error { return nil }
+
+// kafkaSink publishes one message per event, keyed by Actor so all
+// events for a given identity land on the same partition.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(settings map[string]string) (*kafkaSink, error) {
+	brokers := settings["brokers"]
+	if brokers == "" {
+		return nil, fmt.Errorf("kafka sink requires a \"brokers\" setting (comma-separated)")
+	}
+	topic := settings["topic"]
+	if topic == "" {
+		return nil, fmt.Errorf("kafka sink requires a \"topic\" setting")
+	}
+
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+		},
+	}, nil
+}
+
+func (s *kafkaSink) Write(ctx context.Context, events []IAMEvent) error {
+	msgs := make([]kafka.Message, 0, len(events))
+	for _, ev := range events {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(ev.Actor),
+			Value: value,
+		})
+	}
+	return s.writer.WriteMessages(ctx, msgs...)
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+// rollingJSONLWriter is the shared roll-by-size-or-time logic behind
+// fileSink and s3Sink: append newline-delimited JSON to an in-memory (or
+// on-disk) buffer, and hand a completed chunk to flush once it crosses
+// maxBytes or maxAge.
+type rollingJSONLWriter struct {
+	maxBytes int
+	maxAge   time.Duration
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	openedAt time.Time
+	flush    func(chunk []byte) error
+}
+
+func newRollingJSONLWriter(maxBytes int, maxAge time.Duration, flush func([]byte) error) *rollingJSONLWriter {
+	return &rollingJSONLWriter{maxBytes: maxBytes, maxAge: maxAge, flush: flush}
+}
+
+func (w *rollingJSONLWriter) Write(events []IAMEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() == 0 {
+		w.openedAt = time.Now()
+	}
+	for _, ev := range events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		w.buf.Write(line)
+		w.buf.WriteByte('\n')
+	}
+
+	if w.buf.Len() >= w.maxBytes || (w.buf.Len() > 0 && time.Since(w.openedAt) >= w.maxAge) {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+func (w *rollingJSONLWriter) flushLocked() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	chunk := append([]byte(nil), w.buf.Bytes()...)
+	w.buf.Reset()
+	return w.flush(chunk)
+}
+
+func (w *rollingJSONLWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+const (
+	sinkDefaultRollBytes = 5 << 20 // 5MB
+	sinkDefaultRollAge   = 60 * time.Second
+)
+
+// fileSink rolls JSONL objects to local disk by size/time, named
+// <prefix>-<unix-nanos>.jsonl, for cheap on-box archival or when there's
+// no S3 bucket to archive to.
+type fileSink struct {
+	dir    string
+	prefix string
+	roller *rollingJSONLWriter
+}
+
+func newFileSink(settings map[string]string) (*fileSink, error) {
+	dir := settings["dir"]
+	if dir == "" {
+		dir = "."
+	}
+	prefix := settings["prefix"]
+	if prefix == "" {
+		prefix = "iam_events"
+	}
+	maxBytes, maxAge := rollSettings(settings)
+
+	s := &fileSink{dir: dir, prefix: prefix}
+	s.roller = newRollingJSONLWriter(maxBytes, maxAge, s.writeChunk)
+	return s, nil
+}
+
+func (s *fileSink) writeChunk(chunk []byte) error {
+	name := fmt.Sprintf("%s-%d.jsonl", s.prefix, time.Now().UnixNano())
+	return os.WriteFile(s.dir+string(os.PathSeparator)+name, chunk, 0o644)
+}
+
+func (s *fileSink) Write(ctx context.Context, events []IAMEvent) error {
+	return s.roller.Write(events)
+}
+
+func (s *fileSink) Close() error {
+	return s.roller.Flush()
+}
+
+// s3Sink rolls JSONL objects to S3 by size/time, for cheap long-term
+// archival of the raw event stream.
+type s3Sink struct {
+	s3     *s3.Client
+	bucket string
+	prefix string
+	roller *rollingJSONLWriter
+}
+
+func newS3Sink(ctx context.Context, settings map[string]string) (*s3Sink, error) {
+	bucket := settings["bucket"]
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 sink requires a \"bucket\" setting")
+	}
+	prefix := settings["prefix"]
+	if prefix == "" {
+		prefix = "iam_events"
+	}
+
+	var optFns []func(*config.LoadOptions) error
+	if profile := settings["aws_profile"]; profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	maxBytes, maxAge := rollSettings(settings)
+
+	s := &s3Sink{s3: s3.NewFromConfig(cfg), bucket: bucket, prefix: prefix}
+	s.roller = newRollingJSONLWriter(maxBytes, maxAge, s.writeChunk)
+	return s, nil
+}
+
+func (s *s3Sink) writeChunk(chunk []byte) error {
+	key := fmt.Sprintf("%s/%s-%d.jsonl", s.prefix, time.Now().UTC().Format("2006/01/02"), time.Now().UnixNano())
+	_, err := s.s3.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(chunk),
+	})
+	if err != nil {
+		return fmt.Errorf("put s3 object s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3Sink) Write(ctx context.Context, events []IAMEvent) error {
+	return s.roller.Write(events)
+}
+
+func (s *s3Sink) Close() error {
+	return s.roller.Flush()
+}
+
+func rollSettings(settings map[string]string) (maxBytes int, maxAge time.Duration) {
+	maxBytes = sinkDefaultRollBytes
+	if v := settings["max_bytes"]; v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			maxBytes = n
+		}
+	}
+	maxAge = sinkDefaultRollAge
+	if v := settings["max_age_seconds"]; v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			maxAge = time.Duration(n) * time.Second
+		}
+	}
+	return maxBytes, maxAge
+}
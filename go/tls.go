@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfigBuilder builds the *tls.Config used by buildClient, selecting
+// one of three modes via PIPELINE_TLS_MODE:
+//
+//	"insecure" - skip verification entirely (lab-only, today's default behavior)
+//	"system"   - verify against the system root CA pool
+//	"ca_bundle" - verify against a user-supplied CA bundle file (PIPELINE_TLS_CA_FILE)
+//	"bootstrap" - request a short-lived client certificate from an
+//	              internal CA for mTLS, and transparently renew it
+//
+// The zero value is not usable; construct via NewTLSConfigBuilder.
+type TLSConfigBuilder struct {
+	mode      string
+	caFile    string
+	bootstrap *certBootstrapper
+}
+
+// NewTLSConfigBuilder reads PIPELINE_TLS_MODE and wires up whatever that
+// mode needs. Insecure mode must be requested explicitly; there is no
+// default that accidentally disables verification.
+//
+//	PIPELINE_TLS_MODE = "insecure" | "system" | "ca_bundle" | "bootstrap"
+//
+//	ca_bundle mode:
+//	  PIPELINE_TLS_CA_FILE
+//
+//	bootstrap mode:
+//	  PIPELINE_TLS_BOOTSTRAP_CA_URL    base URL of the internal CA
+//	  PIPELINE_TLS_BOOTSTRAP_TOKEN     one-time enrollment token
+func NewTLSConfigBuilder() (*TLSConfigBuilder, error) {
+	mode := getEnvOrDefault("PIPELINE_TLS_MODE", "system")
+
+	b := &TLSConfigBuilder{mode: mode}
+	switch mode {
+	case "insecure", "system":
+		return b, nil
+	case "ca_bundle":
+		b.caFile = getEnvOrFail("PIPELINE_TLS_CA_FILE")
+		return b, nil
+	case "bootstrap":
+		b.bootstrap = newCertBootstrapper(
+			getEnvOrFail("PIPELINE_TLS_BOOTSTRAP_CA_URL"),
+			getEnvOrFail("PIPELINE_TLS_BOOTSTRAP_TOKEN"),
+		)
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown PIPELINE_TLS_MODE %q (want \"insecure\", \"system\", \"ca_bundle\" or \"bootstrap\")", mode)
+	}
+}
+
+// Build returns a *tls.Config for the configured mode. For "bootstrap"
+// mode it blocks on the initial certificate request and starts a
+// background renewal goroutine.
+func (b *TLSConfigBuilder) Build() (*tls.Config, error) {
+	switch b.mode {
+	case "insecure":
+		return &tls.Config{InsecureSkipVerify: true}, nil // lab-only!
+
+	case "system":
+		return &tls.Config{}, nil
+
+	case "ca_bundle":
+		pem, err := os.ReadFile(b.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle %s: %w", b.caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates parsed from CA bundle %s", b.caFile)
+		}
+		return &tls.Config{RootCAs: pool}, nil
+
+	case "bootstrap":
+		if err := b.bootstrap.bootstrap(); err != nil {
+			return nil, fmt.Errorf("bootstrap client certificate: %w", err)
+		}
+		go b.bootstrap.renewLoop()
+		return &tls.Config{
+			GetClientCertificate: b.bootstrap.getClientCertificate,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", b.mode)
+	}
+}
+
+// certBootstrapper requests a short-lived client certificate from an
+// internal CA using a one-time token, and renews it in the background
+// once ~2/3 of its lifetime has elapsed so a long-running process never
+// ships with a permanently-valid (or stale) credential.
+type certBootstrapper struct {
+	caURL string
+	token string
+	http  *http.Client
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	issued  time.Time
+	expires time.Time
+}
+
+func newCertBootstrapper(caURL, token string) *certBootstrapper {
+	return &certBootstrapper{
+		caURL: caURL,
+		token: token,
+		http:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type caSignResponse struct {
+	CertificatePEM string `json:"certificate_pem"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+// bootstrap generates a fresh keypair, sends a CSR to the CA (using the
+// one-time token for authentication), and stores the signed certificate.
+// The token is only valid for the first call; renewals reuse it to
+// request a new short-lived cert rather than re-enrolling.
+func (b *certBootstrapper) bootstrap() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate client key: %w", err)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "cloud-security-pipeline"},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("create CSR: %w", err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	reqBody, err := json.Marshal(map[string]string{
+		"token":   b.token,
+		"csr_pem": string(csrPEM),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal CSR request: %w", err)
+	}
+
+	resp, err := b.http.Post(b.caURL+"/sign", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("request signed cert: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 from CA: %s", resp.Status)
+	}
+
+	var signed caSignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return fmt.Errorf("decode CA response: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal client key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair([]byte(signed.CertificatePEM), keyPEM)
+	if err != nil {
+		return fmt.Errorf("parse signed keypair: %w", err)
+	}
+
+	expires, err := time.Parse(time.RFC3339, signed.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("parse cert expiry %q: %w", signed.ExpiresAt, err)
+	}
+
+	b.mu.Lock()
+	b.cert = &cert
+	b.issued = time.Now()
+	b.expires = expires
+	b.mu.Unlock()
+	return nil
+}
+
+// renewLoop re-bootstraps the client certificate once ~2/3 of its
+// lifetime has elapsed, forever. Transient CA errors are logged and
+// retried on a short interval rather than leaving the process to run on
+// an expired cert.
+func (b *certBootstrapper) renewLoop() {
+	for {
+		b.mu.RLock()
+		issued, expires := b.issued, b.expires
+		b.mu.RUnlock()
+
+		wait := issued.Add(expires.Sub(issued) * 2 / 3).Sub(time.Now())
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		time.Sleep(wait)
+
+		if err := b.bootstrap(); err != nil {
+			fmt.Println("Error renewing mTLS client certificate, retrying shortly:", err)
+			time.Sleep(30 * time.Second)
+		}
+	}
+}
+
+func (b *certBootstrapper) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.cert == nil {
+		return nil, fmt.Errorf("no client certificate available yet")
+	}
+	return b.cert, nil
+}